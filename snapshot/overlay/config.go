@@ -0,0 +1,73 @@
+package overlay
+
+// Config controls which optional overlayfs mount options the Snapshotter
+// uses. Any field left nil falls back to the result of the kernel feature
+// probe performed by NewSnapshotter.
+type Config struct {
+	// IndexOn forces `index=on`/`index=off` regardless of the probe
+	// result. Requires kernel 4.13+.
+	IndexOn *bool
+
+	// MetacopyOn forces `metacopy=on`/`metacopy=off` regardless of the
+	// probe result. Requires kernel 4.19+.
+	MetacopyOn *bool
+
+	// RedirectDir forces `redirect_dir=on`/`redirect_dir=off` regardless
+	// of the probe result. Requires kernel 4.10+.
+	RedirectDir *bool
+
+	// Userxattr forces the `userxattr` mount option regardless of the
+	// probe result. Needed on kernels where overlayfs is mounted inside
+	// a user namespace (e.g. rootless).
+	Userxattr *bool
+}
+
+// SnapshotterOpt configures the Config used by NewSnapshotter.
+type SnapshotterOpt func(*Config)
+
+// WithIndexOn force-enables or force-disables `index=on`.
+func WithIndexOn(enabled bool) SnapshotterOpt {
+	return func(c *Config) { c.IndexOn = &enabled }
+}
+
+// WithMetacopyOn force-enables or force-disables `metacopy=on`.
+func WithMetacopyOn(enabled bool) SnapshotterOpt {
+	return func(c *Config) { c.MetacopyOn = &enabled }
+}
+
+// WithRedirectDir force-enables or force-disables `redirect_dir=on`.
+func WithRedirectDir(enabled bool) SnapshotterOpt {
+	return func(c *Config) { c.RedirectDir = &enabled }
+}
+
+// WithUserxattr force-enables or force-disables the `userxattr` option.
+func WithUserxattr(enabled bool) SnapshotterOpt {
+	return func(c *Config) { c.Userxattr = &enabled }
+}
+
+// overlayFeatures records which optional overlayfs mount options the
+// running kernel accepts, as determined by probeFeatures and overridden by
+// a Config.
+type overlayFeatures struct {
+	indexOn     bool
+	metacopyOn  bool
+	redirectDir bool
+	userxattr   bool
+}
+
+// apply overrides any probed value that the Config pins explicitly.
+func (f overlayFeatures) apply(c Config) overlayFeatures {
+	if c.IndexOn != nil {
+		f.indexOn = *c.IndexOn
+	}
+	if c.MetacopyOn != nil {
+		f.metacopyOn = *c.MetacopyOn
+	}
+	if c.RedirectDir != nil {
+		f.redirectDir = *c.RedirectDir
+	}
+	if c.Userxattr != nil {
+		f.userxattr = *c.Userxattr
+	}
+	return f
+}
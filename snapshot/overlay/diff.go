@@ -0,0 +1,465 @@
+package overlay
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutPrefix marks a deleted file in an OCI layer tar.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaqueDir marks a directory as opaque in an OCI layer tar,
+	// meaning none of its lower layers should be visible underneath it.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	// opaqueXattr is the overlayfs xattr set on a directory to make it
+	// opaque to the layers below it.
+	opaqueXattr = "trusted.overlay.opaque"
+)
+
+// Descriptor identifies content produced by Diff: an uncompressed
+// OCI-style layer tar together with its digest and size.
+type Descriptor struct {
+	MediaType string
+	Digest    string
+	Size      int64
+}
+
+// resolveID looks up key's internal, numeric snapshot ID, for comparison
+// against the IDs recorded in storage.Active.ParentIDs. Only active
+// transactions expose their ID through MetaStore today, so a key that
+// names an already-committed snapshot can't be resolved this way; that's
+// reported as ok == false rather than an error, since it's the common
+// case for a Diff/Apply parent, not an exceptional one.
+func (o *Snapshotter) resolveID(ctx context.Context, key string) (id string, ok bool, err error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return "", false, err
+	}
+	defer t.Rollback()
+
+	active, err := o.ms.GetActive(ctx, key)
+	if err != nil {
+		return "", false, nil
+	}
+	return active.ID, true, nil
+}
+
+// Diff walks upperKey's upperdir and streams an OCI-style layer tar,
+// translating overlayfs whiteout devices and opaque-directory xattrs into
+// their ".wh."-prefixed tar equivalents. lowerKey is the snapshot upperKey
+// was prepared against; when it resolves to an active transaction, it is
+// compared against upperKey's recorded parent ID as a sanity check.
+func (o *Snapshotter) Diff(ctx context.Context, lowerKey, upperKey string) (io.ReadCloser, Descriptor, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, Descriptor{}, err
+	}
+
+	upper, err := o.ms.GetActive(ctx, upperKey)
+	t.Rollback()
+	if err != nil {
+		return nil, Descriptor{}, errors.Wrap(err, "failed to get upper snapshot")
+	}
+
+	if len(upper.ParentIDs) > 0 {
+		lowerID, ok, err := o.resolveID(ctx, lowerKey)
+		if err != nil {
+			return nil, Descriptor{}, errors.Wrap(err, "failed to resolve lower snapshot")
+		}
+		if ok && lowerID != upper.ParentIDs[0] {
+			log.G(ctx).WithField("lowerKey", lowerKey).WithField("upperKey", upperKey).
+				Warn("diff requested between snapshots that are not direct parent/child")
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "overlay-diff-")
+	if err != nil {
+		return nil, Descriptor{}, errors.Wrap(err, "failed to create diff tempfile")
+	}
+
+	digest := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(tmp, digest))
+
+	if err := writeDiff(tw, o.upperPath(upper.ID)); err != nil {
+		tw.Close()
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, Descriptor{}, errors.Wrap(err, "failed to write diff")
+	}
+	if err := tw.Close(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, Descriptor{}, errors.Wrap(err, "failed to close tar writer")
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, Descriptor{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, Descriptor{}, err
+	}
+
+	desc := Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+		Digest:    "sha256:" + hex.EncodeToString(digest.Sum(nil)),
+		Size:      info.Size(),
+	}
+
+	return &deleteOnCloseFile{File: tmp}, desc, nil
+}
+
+// deleteOnCloseFile removes its backing file from disk once Close is
+// called, so callers of Diff don't need to know the tempfile's path to
+// clean it up.
+type deleteOnCloseFile struct {
+	*os.File
+}
+
+func (f *deleteOnCloseFile) Close() error {
+	name := f.File.Name()
+	err := f.File.Close()
+	if rerr := os.Remove(name); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// writeDiff walks root and writes each entry to tw, translating overlayfs
+// whiteout markers to their OCI tar equivalents along the way.
+func writeDiff(tw *tar.Writer, root string) error {
+	seen := make(map[uint64]string)
+
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("unsupported stat type for %s", path)
+		}
+
+		// overlayfs marks a deleted file as a character device with
+		// major/minor 0/0; translate it to the OCI whiteout entry.
+		if fi.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0 {
+			dir, base := filepath.Split(rel)
+			return writeWhiteout(tw, filepath.Join(dir, whiteoutPrefix+base), stat)
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Uid = int(stat.Uid)
+		hdr.Gid = int(stat.Gid)
+		if fi.Mode()&os.ModeDevice != 0 {
+			hdr.Devmajor = int64(unix.Major(uint64(stat.Rdev)))
+			hdr.Devminor = int64(unix.Minor(uint64(stat.Rdev)))
+		}
+
+		if fi.IsDir() {
+			opaque, err := getOpaqueXattr(path)
+			if err != nil {
+				return err
+			}
+			if opaque {
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				return writeWhiteout(tw, filepath.Join(rel, whiteoutOpaqueDir), stat)
+			}
+			return tw.WriteHeader(hdr)
+		}
+
+		if !fi.Mode().IsRegular() {
+			if fi.Mode()&os.ModeSymlink != 0 {
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				hdr.Linkname = link
+			}
+			return tw.WriteHeader(hdr)
+		}
+
+		// Preserve hardlinks rather than writing the same content
+		// out multiple times.
+		key := inodeKey(stat)
+		if orig, ok := seen[key]; ok && stat.Nlink > 1 {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = orig
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		seen[key] = rel
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// writeWhiteout writes a whiteout marker entry, carrying over the
+// ownership of the file it replaces so Apply can restore it on the
+// synthetic device node / opaque directory it recreates.
+func writeWhiteout(tw *tar.Writer, name string, stat *syscall.Stat_t) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Size:     0,
+		Mode:     0600,
+		Uid:      int(stat.Uid),
+		Gid:      int(stat.Gid),
+	})
+}
+
+func inodeKey(stat *syscall.Stat_t) uint64 {
+	return uint64(stat.Dev)<<32 ^ stat.Ino
+}
+
+func getOpaqueXattr(path string) (bool, error) {
+	buf := make([]byte, 8)
+	n, err := unix.Getxattr(path, opaqueXattr, buf)
+	if err != nil {
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(buf[:n]) == "y", nil
+}
+
+// Apply extracts the OCI-style layer tar r into the active snapshot
+// identified by key, translating ".wh."-prefixed entries and
+// ".wh..wh..opq" markers back into overlayfs whiteout devices and opaque
+// directory xattrs respectively. parent is the snapshot key is expected
+// to have been prepared against, and is used for the same sanity check
+// Diff performs against lowerKey.
+func (o *Snapshotter) Apply(ctx context.Context, parent, key string, r io.Reader) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	active, err := o.ms.GetActive(ctx, key)
+	t.Rollback()
+	if err != nil {
+		return errors.Wrap(err, "failed to get active snapshot")
+	}
+
+	if len(active.ParentIDs) > 0 {
+		parentID, ok, err := o.resolveID(ctx, parent)
+		if err != nil {
+			return errors.Wrap(err, "failed to resolve parent snapshot")
+		}
+		if ok && parentID != active.ParentIDs[0] {
+			log.G(ctx).WithField("parent", parent).WithField("key", key).
+				Warn("apply requested against a snapshot that was not prepared from parent")
+		}
+	}
+
+	root := o.upperPath(active.ID)
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read tar header")
+		}
+
+		target, err := securejoin(root, hdr.Name)
+		if err != nil {
+			return errors.Wrapf(err, "invalid tar entry %s", hdr.Name)
+		}
+
+		dir, base := filepath.Split(target)
+
+		if base == whiteoutOpaqueDir {
+			if err := unix.Setxattr(filepath.Clean(dir), opaqueXattr, []byte("y"), 0); err != nil {
+				return errors.Wrapf(err, "failed to set opaque xattr on %s", dir)
+			}
+			if err := os.Lchown(filepath.Clean(dir), hdr.Uid, hdr.Gid); err != nil {
+				log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to restore ownership on opaque directory")
+			}
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			whiteoutTarget := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			os.RemoveAll(whiteoutTarget)
+			if err := unix.Mknod(whiteoutTarget, unix.S_IFCHR, 0); err != nil {
+				return errors.Wrapf(err, "failed to create whiteout device at %s", whiteoutTarget)
+			}
+			if err := os.Lchown(whiteoutTarget, hdr.Uid, hdr.Gid); err != nil {
+				log.G(ctx).WithError(err).WithField("path", whiteoutTarget).Warn("failed to restore ownership on whiteout device")
+			}
+			continue
+		}
+
+		if err := applyEntry(root, target, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func applyEntry(root, target string, hdr *tar.Header, tr *tar.Reader) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		cerr := f.Close()
+		if err != nil {
+			return err
+		}
+		if cerr != nil {
+			return cerr
+		}
+	case tar.TypeSymlink:
+		os.RemoveAll(target)
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		os.RemoveAll(target)
+		if err := os.Link(filepath.Join(root, filepath.FromSlash(hdr.Linkname)), target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		os.RemoveAll(target)
+		if err := unix.Mknod(target, devNodeMode(hdr), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported tar entry type %v for %s", hdr.Typeflag, hdr.Name)
+	}
+
+	if hdr.Typeflag != tar.TypeLink {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return errors.Wrapf(err, "failed to chown %s", target)
+		}
+	}
+
+	return nil
+}
+
+// devNodeMode returns the mknod(2) mode argument for a device or FIFO tar
+// entry: the node's permission bits combined with the S_IF* type implied
+// by hdr.Typeflag.
+func devNodeMode(hdr *tar.Header) uint32 {
+	var typeBit uint32
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		typeBit = unix.S_IFCHR
+	case tar.TypeBlock:
+		typeBit = unix.S_IFBLK
+	case tar.TypeFifo:
+		typeBit = unix.S_IFIFO
+	}
+	return typeBit | uint32(os.FileMode(hdr.Mode).Perm())
+}
+
+// securejoin joins root and the tar-provided name, resolving symlink path
+// components against root as it goes so a tar entry can't escape root by
+// writing through a symlink staged earlier in the same stream (e.g.
+// "etc -> /" followed by "etc/passwd").
+func securejoin(root, name string) (string, error) {
+	unsafe := filepath.Join(string(filepath.Separator), filepath.FromSlash(name))
+	parts := strings.Split(unsafe, string(filepath.Separator))
+
+	current := root
+	for _, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+
+		next := filepath.Join(current, part)
+
+		fi, err := os.Lstat(next)
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			link = filepath.Join(root, link)
+		} else {
+			link = filepath.Join(filepath.Dir(next), link)
+		}
+		if !withinRoot(root, link) {
+			return "", errors.Errorf("path escapes root via symlink: %s", name)
+		}
+		current = link
+	}
+
+	if !withinRoot(root, current) {
+		return "", errors.Errorf("path escapes root: %s", name)
+	}
+
+	return current, nil
+}
+
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,177 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteDiffHardlinksAndSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeDiff(tw, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = hdr
+	}
+
+	a, ok := entries["a"]
+	if !ok || a.Typeflag != tar.TypeReg {
+		t.Fatalf("expected regular file entry for a, got %+v", a)
+	}
+
+	b, ok := entries["b"]
+	if !ok {
+		t.Fatal("expected entry for hardlinked file b")
+	}
+	if b.Typeflag != tar.TypeLink || b.Linkname != "a" {
+		t.Fatalf("expected b to be recorded as a hardlink to a, got %+v", b)
+	}
+
+	c, ok := entries["c"]
+	if !ok || c.Typeflag != tar.TypeSymlink || c.Linkname != "a" {
+		t.Fatalf("expected symlink entry for c -> a, got %+v", c)
+	}
+}
+
+func TestWriteDiffAndApplyRoundTripDeviceNode(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	devPath := filepath.Join(root, "null")
+	if err := unix.Mknod(devPath, unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+		t.Skipf("mknod not permitted in this environment: %v", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeDiff(tw, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "overlay-diff-apply-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, err := securejoin(dest, hdr.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyEntry(dest, target, hdr, tr); err != nil {
+			t.Fatalf("Apply could not ingest its own diff output: %v", err)
+		}
+	}
+
+	fi, err := os.Lstat(filepath.Join(dest, "null"))
+	if err != nil {
+		t.Fatalf("expected device node to be recreated by Apply: %v", err)
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		t.Fatalf("expected a character device node, got mode %v", fi.Mode())
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Fatal("expected a *syscall.Stat_t")
+	}
+	if unix.Major(uint64(stat.Rdev)) != 1 || unix.Minor(uint64(stat.Rdev)) != 3 {
+		t.Fatalf("expected recreated device to be 1:3, got %d:%d",
+			unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))
+	}
+}
+
+func TestSecurejoinRejectsSymlinkEscape(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-securejoin-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Simulate a tar stream that stages a symlink pointing outside root
+	// and then tries to write through it. An absolute target such as "/"
+	// is resolved against root by securejoin, so a relative one is used.
+	if err := os.Symlink("../../..", filepath.Join(root, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := securejoin(root, "etc/passwd"); err == nil {
+		t.Fatal("expected securejoin to reject a path written through a symlink escaping root")
+	}
+}
+
+func TestSecurejoinAllowsContainedPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-securejoin-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := securejoin(root, "link/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Join(root, "a", "b") {
+		t.Fatalf("expected %s, got %s", filepath.Join(root, "a", "b"), target)
+	}
+}
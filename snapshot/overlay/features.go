@@ -0,0 +1,63 @@
+package overlay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeFeatures mounts a series of throwaway overlay filesystems under
+// root, one per candidate option, and reports which ones the running
+// kernel accepts. It is run once, at NewSnapshotter time, so that the
+// cost of failed probe mounts isn't paid on every Prepare/View.
+func probeFeatures(root string) (overlayFeatures, error) {
+	var f overlayFeatures
+
+	tmp, err := ioutil.TempDir(root, "probe-")
+	if err != nil {
+		return f, fmt.Errorf("failed to create probe dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	lower := filepath.Join(tmp, "lower")
+	upper := filepath.Join(tmp, "upper")
+	work := filepath.Join(tmp, "work")
+	merged := filepath.Join(tmp, "merged")
+	for _, dir := range []string{lower, upper, work, merged} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return f, err
+		}
+	}
+
+	f.indexOn = tryMount(lower, upper, work, merged, "index=on")
+	f.metacopyOn = tryMount(lower, upper, work, merged, "metacopy=on")
+	f.redirectDir = tryMount(lower, upper, work, merged, "redirect_dir=on")
+	f.userxattr = tryMount(lower, upper, work, merged, "userxattr")
+
+	return f, nil
+}
+
+// tryMount attempts to mount an overlay at merged using lower/upper/work
+// plus extraOpt, reporting whether the kernel accepted the option. The
+// mount is torn down immediately, and upper/work are reset so a
+// subsequent probe against the same directories starts clean.
+func tryMount(lower, upper, work, merged, extraOpt string) bool {
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,%s", lower, upper, work, extraOpt)
+	if err := unix.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return false
+	}
+
+	if err := unix.Unmount(merged, 0); err != nil {
+		return false
+	}
+
+	os.RemoveAll(upper)
+	os.RemoveAll(work)
+	os.MkdirAll(upper, 0700)
+	os.MkdirAll(work, 0700)
+
+	return true
+}
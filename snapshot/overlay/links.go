@@ -0,0 +1,71 @@
+package overlay
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// maxLowerDirLength caps the length of the joined lowerdir= mount option
+// value. The kernel passes mount(2) data through a single page, so a long
+// lowerdir (many layers, deep root path) can overflow it; this is well
+// short of a page to leave room for the other overlay options.
+const maxLowerDirLength = 3988
+
+// shortIDLength matches the length docker's overlay2 driver uses for its
+// "l/<id>" symlinks.
+const shortIDLength = 26
+
+// linksDir is the shared directory holding short symlinks to individual
+// snapshots' upperdirs, used to keep lowerdir= within the kernel's
+// mount(2) data page limit.
+func (o *Snapshotter) linksDir() string {
+	return filepath.Join(o.root, "l")
+}
+
+// shortLowerPath returns a short path (rooted at linksDir) that resolves
+// to id's upperdir, creating the symlink on first use. The mapping is
+// recorded in a "link" file inside the snapshot's own directory so it is
+// reused, rather than regenerated, on every call.
+func (o *Snapshotter) shortLowerPath(id string) (string, error) {
+	linkFile := filepath.Join(o.root, "snapshots", id, "link")
+
+	if name, err := ioutil.ReadFile(linkFile); err == nil {
+		return filepath.Join(o.linksDir(), string(name)), nil
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "failed to read link file")
+	}
+
+	if err := os.MkdirAll(o.linksDir(), 0700); err != nil {
+		return "", errors.Wrap(err, "failed to create links dir")
+	}
+
+	name, err := newShortID()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate short id")
+	}
+
+	if err := os.Symlink(o.upperPath(id), filepath.Join(o.linksDir(), name)); err != nil {
+		return "", errors.Wrap(err, "failed to create short link")
+	}
+
+	if err := ioutil.WriteFile(linkFile, []byte(name), 0600); err != nil {
+		return "", errors.Wrap(err, "failed to persist link file")
+	}
+
+	return filepath.Join(o.linksDir(), name), nil
+}
+
+// newShortID returns a random base32 string of shortIDLength characters,
+// suitable for use as a short symlink name.
+func newShortID() (string, error) {
+	b := make([]byte, shortIDLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:shortIDLength], nil
+}
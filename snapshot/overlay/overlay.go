@@ -12,6 +12,7 @@ import (
 	"github.com/docker/containerd/log"
 	"github.com/docker/containerd/plugin"
 	"github.com/docker/containerd/snapshot"
+	"github.com/docker/containerd/snapshot/overlay/quota"
 	"github.com/docker/containerd/snapshot/storage"
 	"github.com/docker/containerd/snapshot/storage/boltdb"
 	"github.com/pkg/errors"
@@ -26,14 +27,35 @@ func init() {
 			if err != nil {
 				return nil, err
 			}
-			return NewSnapshotter(root, ms)
+			return NewSnapshotter(ic.Context, root, ms)
+		},
+	})
+
+	// The overlay snapshotter can also produce and ingest layer tars
+	// directly from its upperdirs, so it is additionally registered as
+	// a diff plugin, sharing the same Snapshotter instance.
+	plugin.Register("diff-overlay", &plugin.Registration{
+		Type:     plugin.DiffPlugin,
+		Requires: []plugin.Type{plugin.SnapshotPlugin},
+		Init: func(ic *plugin.InitContext) (interface{}, error) {
+			s, err := ic.Get(plugin.SnapshotPlugin)
+			if err != nil {
+				return nil, err
+			}
+			o, ok := s.(*Snapshotter)
+			if !ok {
+				return nil, errors.New("snapshot-overlay plugin did not return an overlay.Snapshotter")
+			}
+			return o, nil
 		},
 	})
 }
 
 type Snapshotter struct {
-	root string
-	ms   storage.MetaStore
+	root     string
+	ms       storage.MetaStore
+	quotaCtl *quota.Control
+	features overlayFeatures
 }
 
 type activeSnapshot struct {
@@ -43,7 +65,35 @@ type activeSnapshot struct {
 	readonly bool
 }
 
-func NewSnapshotter(root string, ms storage.MetaStore) (snapshot.Snapshotter, error) {
+type options struct {
+	sizeLimit uint64
+}
+
+// sizeLimitKey is the context key under which WithSizeLimit stores its
+// options value. Carrying it on the context, rather than as a variadic
+// parameter on Prepare/View, keeps those methods at the fixed arity the
+// snapshot.Snapshotter interface requires.
+type sizeLimitKey struct{}
+
+// WithSizeLimit returns a copy of ctx that, when passed to Prepare or
+// View, caps the size, in bytes, of the upperdir of the resulting active
+// snapshot using a project quota. If the backing filesystem does not
+// support project quotas, the limit is ignored and a warning is logged.
+func WithSizeLimit(ctx context.Context, size uint64) context.Context {
+	return context.WithValue(ctx, sizeLimitKey{}, size)
+}
+
+// optionsFromContext extracts any options stashed on ctx by WithSizeLimit
+// (or the zero value, if none were).
+func optionsFromContext(ctx context.Context) options {
+	var o options
+	if size, ok := ctx.Value(sizeLimitKey{}).(uint64); ok {
+		o.sizeLimit = size
+	}
+	return o
+}
+
+func NewSnapshotter(ctx context.Context, root string, ms storage.MetaStore, opts ...SnapshotterOpt) (snapshot.Snapshotter, error) {
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
 	}
@@ -52,10 +102,38 @@ func NewSnapshotter(root string, ms storage.MetaStore) (snapshot.Snapshotter, er
 		return nil, err
 	}
 
-	return &Snapshotter{
-		root: root,
-		ms:   ms,
-	}, nil
+	quotaCtl, err := quota.NewControl(root)
+	if err != nil {
+		if err != quota.ErrQuotaNotSupported {
+			return nil, errors.Wrap(err, "failed to initialize quota controller")
+		}
+		log.L.WithError(err).Warn("disk quota enforcement disabled, backing filesystem does not support project quotas")
+		quotaCtl = nil
+	}
+
+	var config Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	features, err := probeFeatures(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to probe overlay features")
+	}
+	features = features.apply(config)
+
+	o := &Snapshotter{
+		root:     root,
+		ms:       ms,
+		quotaCtl: quotaCtl,
+		features: features,
+	}
+
+	if err := o.Reconcile(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to reconcile snapshot directories")
+	}
+
+	return o, nil
 }
 
 // Stat returns the info for an active or committed snapshot by name or
@@ -94,7 +172,7 @@ func (o *Snapshotter) Mounts(ctx context.Context, key string) ([]containerd.Moun
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get active mount")
 	}
-	return o.mounts(active), nil
+	return o.mounts(active)
 }
 
 func (o *Snapshotter) Commit(ctx context.Context, name, key string) error {
@@ -131,6 +209,12 @@ func (o *Snapshotter) Remove(ctx context.Context, key string) (err error) {
 		return errors.Wrap(err, "failed to remove")
 	}
 
+	if o.quotaCtl != nil {
+		if qerr := o.quotaCtl.ClearQuota(id); qerr != nil {
+			log.G(ctx).WithError(qerr).WithField("id", id).Warn("failed to release disk quota")
+		}
+	}
+
 	path := filepath.Join(o.root, "snapshots", id)
 	renamed := filepath.Join(o.root, "snapshots", "rm-"+id)
 	if err := os.Rename(path, renamed); err != nil {
@@ -165,6 +249,8 @@ func (o *Snapshotter) Walk(ctx context.Context, fn func(context.Context, snapsho
 }
 
 func (o *Snapshotter) createActive(ctx context.Context, key, parent string, readonly bool) ([]containerd.Mount, error) {
+	options := optionsFromContext(ctx)
+
 	var (
 		path        string
 		snapshotDir = filepath.Join(o.root, "snapshots")
@@ -220,14 +306,27 @@ func (o *Snapshotter) createActive(ctx context.Context, key, parent string, read
 	}
 	td = ""
 
+	if options.sizeLimit > 0 {
+		if o.quotaCtl != nil {
+			if err := o.quotaCtl.SetQuota(active.ID, o.upperPath(active.ID), options.sizeLimit); err != nil {
+				if rerr := t.Rollback(); rerr != nil {
+					log.G(ctx).WithError(rerr).Warn("Failure rolling back transaction")
+				}
+				return nil, errors.Wrap(err, "failed to apply disk quota")
+			}
+		} else {
+			log.G(ctx).WithField("key", key).Warn("disk quota requested but not supported by backing filesystem, ignoring")
+		}
+	}
+
 	if err := t.Commit(); err != nil {
 		return nil, errors.Wrap(err, "commit failed")
 	}
 
-	return o.mounts(active), nil
+	return o.mounts(active)
 }
 
-func (o *Snapshotter) mounts(active storage.Active) []containerd.Mount {
+func (o *Snapshotter) mounts(active storage.Active) ([]containerd.Mount, error) {
 	if len(active.ParentIDs) == 0 {
 		// if we only have one layer/no parents then just return a bind mount as overlay
 		// will not work
@@ -245,7 +344,7 @@ func (o *Snapshotter) mounts(active storage.Active) []containerd.Mount {
 					"rbind",
 				},
 			},
-		}
+		}, nil
 	}
 	var options []string
 
@@ -254,6 +353,12 @@ func (o *Snapshotter) mounts(active storage.Active) []containerd.Mount {
 			fmt.Sprintf("workdir=%s", o.workPath(active.ID)),
 			fmt.Sprintf("upperdir=%s", o.upperPath(active.ID)),
 		)
+		if o.features.indexOn {
+			options = append(options, "index=on")
+		}
+		if o.features.metacopyOn {
+			options = append(options, "metacopy=on")
+		}
 	} else if len(active.ParentIDs) == 1 {
 		return []containerd.Mount{
 			{
@@ -264,7 +369,14 @@ func (o *Snapshotter) mounts(active storage.Active) []containerd.Mount {
 					"rbind",
 				},
 			},
-		}
+		}, nil
+	}
+
+	if o.features.redirectDir {
+		options = append(options, "redirect_dir=on")
+	}
+	if o.features.userxattr {
+		options = append(options, "userxattr")
 	}
 
 	parentPaths := make([]string, len(active.ParentIDs))
@@ -272,15 +384,29 @@ func (o *Snapshotter) mounts(active storage.Active) []containerd.Mount {
 		parentPaths[i] = o.upperPath(active.ParentIDs[i])
 	}
 
-	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
+	lowerdir := strings.Join(parentPaths, ":")
+	if len(lowerdir) > maxLowerDirLength {
+		// The joined lowerdir won't fit in the kernel's single-page
+		// mount(2) data buffer; fall back to short symlinks under
+		// root/l, mirroring docker's overlay2 driver.
+		for i := range active.ParentIDs {
+			short, err := o.shortLowerPath(active.ParentIDs[i])
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to shorten lowerdir")
+			}
+			parentPaths[i] = short
+		}
+		lowerdir = strings.Join(parentPaths, ":")
+	}
+
+	options = append(options, fmt.Sprintf("lowerdir=%s", lowerdir))
 	return []containerd.Mount{
 		{
 			Type:    "overlay",
 			Source:  "overlay",
 			Options: options,
 		},
-	}
-
+	}, nil
 }
 
 func (o *Snapshotter) upperPath(id string) string {
@@ -0,0 +1,131 @@
+package overlay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/containerd/snapshot/storage"
+)
+
+func newTestRoot(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "overlay-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func optionSet(options []string) map[string]bool {
+	set := make(map[string]bool, len(options))
+	for _, o := range options {
+		set[o] = true
+	}
+	return set
+}
+
+func TestMountsComposesProbedOptions(t *testing.T) {
+	o := &Snapshotter{
+		root: newTestRoot(t),
+		features: overlayFeatures{
+			indexOn:     true,
+			metacopyOn:  true,
+			redirectDir: true,
+			userxattr:   true,
+		},
+	}
+
+	active := storage.Active{
+		ID:        "2",
+		ParentIDs: []string{"1"},
+		Readonly:  false,
+	}
+
+	mounts, err := o.mounts(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		t.Fatalf("expected a single overlay mount, got %+v", mounts)
+	}
+
+	set := optionSet(mounts[0].Options)
+	for _, want := range []string{"index=on", "metacopy=on", "redirect_dir=on", "userxattr"} {
+		if !set[want] {
+			t.Errorf("expected option %q in %v", want, mounts[0].Options)
+		}
+	}
+}
+
+func TestMountsOmitsUnsupportedOptions(t *testing.T) {
+	o := &Snapshotter{
+		root:     newTestRoot(t),
+		features: overlayFeatures{},
+	}
+
+	active := storage.Active{
+		ID:        "2",
+		ParentIDs: []string{"1"},
+		Readonly:  false,
+	}
+
+	mounts, err := o.mounts(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := optionSet(mounts[0].Options)
+	for _, unwanted := range []string{"index=on", "metacopy=on", "redirect_dir=on", "userxattr"} {
+		if set[unwanted] {
+			t.Errorf("did not expect option %q in %v", unwanted, mounts[0].Options)
+		}
+	}
+}
+
+func TestMountsShortensLongLowerdir(t *testing.T) {
+	o := &Snapshotter{
+		root: newTestRoot(t),
+	}
+
+	// shortLowerPath persists its mapping under
+	// root/snapshots/<id>/link, so that directory needs to exist before
+	// mounts() can shorten a reference to it.
+	if err := os.MkdirAll(filepath.Join(o.root, "snapshots", "0123456789"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	parentIDs := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		parentIDs = append(parentIDs, "0123456789")
+	}
+
+	active := storage.Active{
+		ID:        "active",
+		ParentIDs: parentIDs,
+		Readonly:  false,
+	}
+
+	mounts, err := o.mounts(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lowerdir string
+	for _, opt := range mounts[0].Options {
+		if strings.HasPrefix(opt, "lowerdir=") {
+			lowerdir = strings.TrimPrefix(opt, "lowerdir=")
+		}
+	}
+	if lowerdir == "" {
+		t.Fatal("expected a lowerdir option")
+	}
+	if len(lowerdir) > maxLowerDirLength {
+		t.Fatalf("lowerdir of length %d exceeds max %d", len(lowerdir), maxLowerDirLength)
+	}
+	if !strings.Contains(lowerdir, "/l/") {
+		t.Fatalf("expected shortened lowerdir to use links dir, got %s", lowerdir)
+	}
+}
@@ -0,0 +1,258 @@
+// +build linux
+
+// Package quota provides a minimal API for applying XFS and ext4 project
+// quotas to a directory tree. It is used by the overlay snapshotter to cap
+// the size of an active snapshot's upperdir without requiring a dedicated
+// filesystem or block device per snapshot.
+package quota
+
+/*
+#include <stdlib.h>
+#include <dirent.h>
+#include <linux/fs.h>
+#include <linux/quota.h>
+#include <linux/dqblk_xfs.h>
+
+#ifndef FS_XFLAG_PROJINHERIT
+struct fsxattr {
+	__u32 fsx_xflags;
+	__u32 fsx_extsize;
+	__u32 fsx_nextents;
+	__u32 fsx_projid;
+	__u32 fsx_cowextsize;
+	unsigned char fsx_pad[8];
+};
+#define FS_XFLAG_PROJINHERIT 0x00000200
+#endif
+
+#ifndef FS_IOC_FSGETXATTR
+#define FS_IOC_FSGETXATTR _IOR('X', 31, struct fsxattr)
+#endif
+
+#ifndef FS_IOC_FSSETXATTR
+#define FS_IOC_FSSETXATTR _IOW('X', 32, struct fsxattr)
+#endif
+
+#ifndef PRJQUOTA
+#define PRJQUOTA 2
+#endif
+
+#ifndef FS_PROJ_QUOTA
+#define FS_PROJ_QUOTA 2
+#endif
+
+#ifndef Q_XGETPQUOTA
+#define Q_XGETPQUOTA QCMD(Q_XGETQUOTA, PRJQUOTA)
+#endif
+
+#ifndef Q_XSETPQLIM
+#define Q_XSETPQLIM QCMD(Q_XSETQLIM, PRJQUOTA)
+#endif
+
+static int set_project_id(int fd, __u32 id) {
+	struct fsxattr fsx;
+	if (ioctl(fd, FS_IOC_FSGETXATTR, &fsx) < 0) {
+		return -1;
+	}
+	fsx.fsx_projid = id;
+	fsx.fsx_xflags |= FS_XFLAG_PROJINHERIT;
+	return ioctl(fd, FS_IOC_FSSETXATTR, &fsx);
+}
+
+static int set_project_quota(const char *dev, __u32 id, __u64 bytes) {
+	struct fs_disk_quota d;
+	memset(&d, 0, sizeof(d));
+	d.d_version = FS_DQUOT_VERSION;
+	d.d_id = id;
+	d.d_flags = FS_PROJ_QUOTA;
+	d.d_fieldmask = FS_DQ_BSOFT | FS_DQ_BHARD;
+	d.d_blk_softlimit = bytes / 512;
+	d.d_blk_hardlimit = bytes / 512;
+	return quotactl(Q_XSETPQLIM, dev, id, (caddr_t)&d);
+}
+*/
+import "C"
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrQuotaNotSupported is returned by NewControl when the backing
+// filesystem of the given path does not support project quotas, e.g. the
+// filesystem is not XFS/ext4, or it is missing the `prjquota`/`pquota`
+// mount option.
+var ErrQuotaNotSupported = errors.New("quota: backing filesystem does not support project quotas")
+
+// Control allocates and applies project quotas to directories on a single
+// backing filesystem. A Control must not be shared across filesystems, as
+// project IDs are only unique per device.
+type Control struct {
+	mu      sync.Mutex
+	backend string            // device backing basePath, as found in /proc/mounts
+	nextID  uint32            // next project ID to hand out
+	ids     map[string]uint32 // snapshot ID -> project ID
+	idsPath string            // where ids is persisted, for restart recovery
+}
+
+// NewControl probes basePath's filesystem for project quota support and
+// returns a Control that can apply quotas to directories rooted under it.
+// It returns ErrQuotaNotSupported if the filesystem does not support (or
+// has not enabled) project quotas, in which case callers should fall back
+// to unlimited snapshots.
+func NewControl(basePath string) (*Control, error) {
+	backend, err := backingDevice(basePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve backing device")
+	}
+
+	// Project ID 0 is reserved for "no project"; probe with the highest
+	// ID to confirm the kernel and mount actually honor project quotas
+	// on this device before handing any out for real use.
+	const probeID = ^C.__u32(0)
+	if _, err := C.set_project_quota(C.CString(backend), probeID, 0); err != nil {
+		return nil, ErrQuotaNotSupported
+	}
+
+	c := &Control{
+		backend: backend,
+		nextID:  1,
+		ids:     make(map[string]uint32),
+		idsPath: filepath.Join(basePath, "projectids.json"),
+	}
+	if err := c.load(); err != nil {
+		return nil, errors.Wrap(err, "failed to load persisted project ids")
+	}
+
+	return c, nil
+}
+
+// SetQuota applies a byte limit to targetPath, allocating a new project ID
+// for id if one has not already been assigned. A size of 0 clears any
+// existing limit but keeps the project ID allocated for reuse.
+func (c *Control) SetQuota(id, targetPath string, size uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	projectID, ok := c.ids[id]
+	if !ok {
+		projectID = c.nextID
+		c.nextID++
+	}
+
+	dir, err := os.Open(targetPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open target path")
+	}
+	defer dir.Close()
+
+	if _, err := C.set_project_id(C.int(dir.Fd()), C.__u32(projectID)); err != nil {
+		return errors.Wrap(err, "failed to set project id")
+	}
+
+	if _, err := C.set_project_quota(C.CString(c.backend), C.__u32(projectID), C.__u64(size)); err != nil {
+		return errors.Wrap(err, "failed to set project quota")
+	}
+
+	c.ids[id] = projectID
+	return c.save()
+}
+
+// ClearQuota removes the limit on the project ID associated with id, if
+// any, and forgets the mapping. SetQuota does not hand the released ID out
+// again; it allocates only from nextID. It does not attempt to reset the
+// on-disk xattr, since the directory is expected to be removed by the
+// caller.
+func (c *Control) ClearQuota(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	projectID, ok := c.ids[id]
+	if !ok {
+		return nil
+	}
+
+	if _, err := C.set_project_quota(C.CString(c.backend), C.__u32(projectID), 0); err != nil {
+		return errors.Wrap(err, "failed to clear project quota")
+	}
+
+	delete(c.ids, id)
+	return c.save()
+}
+
+func (c *Control) load() error {
+	b, err := ioutil.ReadFile(c.idsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, &c.ids); err != nil {
+		return err
+	}
+
+	// SetQuota hands out project IDs from nextID, so it must resume past
+	// the highest ID already on disk or a restart will reassign an ID
+	// still backing an existing snapshot's quota.
+	for _, projectID := range c.ids {
+		if projectID >= c.nextID {
+			c.nextID = projectID + 1
+		}
+	}
+	return nil
+}
+
+// save persists the id map so project IDs survive a daemon restart.
+// Caller must hold c.mu.
+func (c *Control) save() error {
+	b, err := json.Marshal(c.ids)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.idsPath, b, 0600)
+}
+
+// backingDevice resolves the device mounted at the longest prefix of path,
+// by scanning /proc/mounts.
+func backingDevice(path string) (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var (
+		dev     string
+		bestLen int
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		device, mountPoint := fields[0], fields[1]
+		if !strings.HasPrefix(path, mountPoint) {
+			continue
+		}
+		if len(mountPoint) > bestLen {
+			dev, bestLen = device, len(mountPoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if dev == "" {
+		return "", errors.Errorf("no mount point found for %s", path)
+	}
+	return dev, nil
+}
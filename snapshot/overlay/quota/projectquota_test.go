@@ -0,0 +1,115 @@
+// +build linux
+
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTestControl returns a Control rooted at a fresh temp directory, or
+// skips the test if the backing filesystem doesn't support project quotas
+// (e.g. tmpfs, or an ext4/XFS mount without quotas enabled).
+func setupTestControl(t *testing.T) (*Control, string) {
+	dir, err := ioutil.TempDir("", "quota-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctl, err := NewControl(dir)
+	if err == ErrQuotaNotSupported {
+		os.RemoveAll(dir)
+		t.Skip("project quotas not supported on test filesystem")
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return ctl, dir
+}
+
+func TestSetAndClearQuota(t *testing.T) {
+	ctl, dir := setupTestControl(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "snapshot-1")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctl.SetQuota("snapshot-1", target, 10<<20); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+
+	id, ok := ctl.ids["snapshot-1"]
+	if !ok || id == 0 {
+		t.Fatalf("expected a project id to be recorded for snapshot-1, got %v", id)
+	}
+
+	if err := ctl.ClearQuota("snapshot-1"); err != nil {
+		t.Fatalf("ClearQuota failed: %v", err)
+	}
+
+	if _, ok := ctl.ids["snapshot-1"]; ok {
+		t.Fatal("expected project id to be released after ClearQuota")
+	}
+}
+
+func TestProjectIDsSurviveRestart(t *testing.T) {
+	ctl, dir := setupTestControl(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "snapshot-1")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.SetQuota("snapshot-1", target, 10<<20); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+
+	reloaded, err := NewControl(dir)
+	if err != nil {
+		t.Fatalf("NewControl failed on reload: %v", err)
+	}
+
+	if reloaded.ids["snapshot-1"] != ctl.ids["snapshot-1"] {
+		t.Fatalf("expected project id to be restored after reload, got %v want %v",
+			reloaded.ids["snapshot-1"], ctl.ids["snapshot-1"])
+	}
+}
+
+func TestNewProjectIDAfterRestartDoesNotCollide(t *testing.T) {
+	ctl, dir := setupTestControl(t)
+	defer os.RemoveAll(dir)
+
+	target1 := filepath.Join(dir, "snapshot-1")
+	if err := os.Mkdir(target1, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.SetQuota("snapshot-1", target1, 10<<20); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+
+	reloaded, err := NewControl(dir)
+	if err != nil {
+		t.Fatalf("NewControl failed on reload: %v", err)
+	}
+
+	// A restart must resume project ID allocation past whatever was
+	// persisted, or the next snapshot ends up sharing snapshot-1's
+	// project ID (and quota) instead of getting its own.
+	target2 := filepath.Join(dir, "snapshot-2")
+	if err := os.Mkdir(target2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.SetQuota("snapshot-2", target2, 10<<20); err != nil {
+		t.Fatalf("SetQuota failed: %v", err)
+	}
+
+	if reloaded.ids["snapshot-2"] == reloaded.ids["snapshot-1"] {
+		t.Fatalf("expected snapshot-2 to get a distinct project id, both got %v", reloaded.ids["snapshot-2"])
+	}
+}
@@ -0,0 +1,27 @@
+// +build !linux
+
+package quota
+
+import "github.com/pkg/errors"
+
+// ErrQuotaNotSupported is returned by NewControl on platforms that have no
+// project quota support at all.
+var ErrQuotaNotSupported = errors.New("quota: project quotas are not supported on this platform")
+
+// Control is a no-op stand-in on platforms without project quota support.
+type Control struct{}
+
+// NewControl always returns ErrQuotaNotSupported on this platform.
+func NewControl(basePath string) (*Control, error) {
+	return nil, ErrQuotaNotSupported
+}
+
+// SetQuota is never called, since NewControl always fails.
+func (c *Control) SetQuota(id, targetPath string, size uint64) error {
+	return ErrQuotaNotSupported
+}
+
+// ClearQuota is never called, since NewControl always fails.
+func (c *Control) ClearQuota(id string) error {
+	return ErrQuotaNotSupported
+}
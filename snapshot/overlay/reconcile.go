@@ -0,0 +1,103 @@
+package overlay
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/containerd/log"
+	"github.com/docker/containerd/snapshot/overlay/quota"
+	"github.com/pkg/errors"
+)
+
+// idEnumerator is implemented by MetaStore backends that can list every
+// snapshot ID they still reference, active or committed. storage.MetaStore
+// itself doesn't require this - Reconcile falls back to skipping the
+// numeric-ID-vs-metastore check when o.ms doesn't implement it - but a
+// backend that can enumerate its own IDs (boltdb's can, by walking its
+// buckets) lets Reconcile actually reclaim a directory orphaned between
+// os.Rename and the metadata commit in createActive, instead of only
+// exercising that path in tests.
+type idEnumerator interface {
+	IDs(ctx context.Context) (map[string]bool, error)
+}
+
+// Reconcile clears out any leftover rm-* and new-* directories under
+// snapshots/, and, if o.ms supports enumerating its IDs, any numeric-ID
+// directory it no longer references. All three can be left behind if the
+// process is killed between a filesystem rename and the metadata
+// transaction that is supposed to accompany it, in Remove and
+// createActive respectively. It is called once, from NewSnapshotter.
+func (o *Snapshotter) Reconcile(ctx context.Context) error {
+	var ids map[string]bool
+	if ie, ok := o.ms.(idEnumerator); ok {
+		ctx, t, err := o.ms.TransactionContext(ctx, false)
+		if err != nil {
+			return err
+		}
+		ids, err = ie.IDs(ctx)
+		t.Rollback()
+		if err != nil {
+			return errors.Wrap(err, "failed to enumerate snapshot ids")
+		}
+	}
+	return reconcileDirectories(ctx, filepath.Join(o.root, "snapshots"), ids, o.quotaCtl)
+}
+
+// reconcileDirectories applies the cleanup rules described on Reconcile
+// to snapshotDir. ids, if non-nil, is the set of snapshot IDs the
+// metastore still references; any numeric-ID directory missing from it
+// is reclaimed too. It is kept free of any storage.MetaStore dependency
+// so it can be exercised directly in tests.
+func reconcileDirectories(ctx context.Context, snapshotDir string, ids map[string]bool, quotaCtl *quota.Control) error {
+	entries, err := ioutil.ReadDir(snapshotDir)
+	if err != nil {
+		return errors.Wrap(err, "failed to list snapshots directory")
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(snapshotDir, name)
+
+		switch {
+		case strings.HasPrefix(name, "rm-"):
+			// Already renamed off its numeric ID by a prior Remove;
+			// release the quota tied to that ID as we drop the
+			// directory.
+			reclaim(ctx, path, name, quotaCtl, strings.TrimPrefix(name, "rm-"))
+		case strings.HasPrefix(name, "new-"):
+			// Never made it far enough through createActive to be
+			// assigned an ID, so it never had a quota applied either.
+			reclaim(ctx, path, name, quotaCtl, "")
+		case ids != nil && strings.Trim(name, "0123456789") == "" && !ids[name]:
+			renamed := filepath.Join(snapshotDir, "rm-"+name)
+			if err := os.Rename(path, renamed); err != nil {
+				log.G(ctx).WithError(err).WithField("id", name).Warn("failed to reclaim orphaned snapshot directory")
+				continue
+			}
+			reclaim(ctx, renamed, "rm-"+name, quotaCtl, name)
+		}
+	}
+
+	return nil
+}
+
+// reclaim removes path, releasing the quota held under id (if any) and
+// logging the outcome under name so repeated reclamation of the same
+// orphan across restarts is visible in the logs.
+func reclaim(ctx context.Context, path, name string, quotaCtl *quota.Control, id string) {
+	if err := os.RemoveAll(path); err != nil {
+		log.G(ctx).WithError(err).WithField("path", name).Warn("failed to remove orphaned snapshot directory")
+		return
+	}
+
+	if id != "" && quotaCtl != nil {
+		if err := quotaCtl.ClearQuota(id); err != nil {
+			log.G(ctx).WithError(err).WithField("id", id).Warn("failed to release disk quota for reclaimed snapshot")
+		}
+	}
+
+	log.G(ctx).WithField("path", name).Info("reclaimed orphaned snapshot directory")
+}
@@ -0,0 +1,83 @@
+package overlay
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mkSnapshotDir creates name under snapshotDir, simulating a directory
+// left on disk by a prior snapshotter process.
+func mkSnapshotDir(t *testing.T, snapshotDir, name string) {
+	if err := os.MkdirAll(filepath.Join(snapshotDir, name), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileRemovesOrphanedRmAndNewDirs(t *testing.T) {
+	snapshotDir, err := ioutil.TempDir("", "overlay-reconcile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(snapshotDir)
+
+	// Simulate a crash between os.Rename(path, renamed) and t.Commit()
+	// in Remove: the "rm-1" directory is on disk but nothing references
+	// it any more.
+	mkSnapshotDir(t, snapshotDir, "rm-1")
+	// Simulate a crash between ioutil.TempDir and t.Commit() in
+	// createActive: the "new-abc123" directory was never renamed to its
+	// final numeric ID.
+	mkSnapshotDir(t, snapshotDir, "new-abc123")
+	// A live, known-good snapshot directory that must survive.
+	mkSnapshotDir(t, snapshotDir, "2")
+
+	ids := map[string]bool{"2": true}
+	if err := reconcileDirectories(context.Background(), snapshotDir, ids, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assertAbsent(t, filepath.Join(snapshotDir, "rm-1"))
+	assertAbsent(t, filepath.Join(snapshotDir, "new-abc123"))
+	assertPresent(t, filepath.Join(snapshotDir, "2"))
+}
+
+func TestReconcileRemovesNumericDirMissingFromMetastore(t *testing.T) {
+	snapshotDir, err := ioutil.TempDir("", "overlay-reconcile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(snapshotDir)
+
+	// Simulate a crash between os.Rename(td, path) and t.Commit() in
+	// createActive: "3" exists on disk under its final numeric name, but
+	// the metadata transaction that would have recorded it never
+	// committed.
+	mkSnapshotDir(t, snapshotDir, "3")
+	mkSnapshotDir(t, snapshotDir, "4")
+
+	ids := map[string]bool{"4": true}
+	if err := reconcileDirectories(context.Background(), snapshotDir, ids, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assertAbsent(t, filepath.Join(snapshotDir, "3"))
+	assertAbsent(t, filepath.Join(snapshotDir, "rm-3"))
+	assertPresent(t, filepath.Join(snapshotDir, "4"))
+}
+
+func assertAbsent(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to have been removed, stat err: %v", path, err)
+	}
+}
+
+func assertPresent(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected %s to still exist: %v", path, err)
+	}
+}